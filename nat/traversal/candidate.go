@@ -0,0 +1,184 @@
+/*
+ * Copyright (C) 2019 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package traversal
+
+import (
+	"net"
+	"sort"
+	"sync"
+
+	log "github.com/cihub/seelog"
+)
+
+// CandidateType classifies how a Candidate address was obtained, ICE-style.
+type CandidateType string
+
+const (
+	// CandidateHost is a local interface address.
+	CandidateHost CandidateType = "host"
+	// CandidateServerReflexive is our address as seen by a STUN server.
+	CandidateServerReflexive CandidateType = "srflx"
+	// CandidateRelay is a port forwarded by the gateway via UPnP/NAT-PMP.
+	CandidateRelay CandidateType = "relay"
+)
+
+// Candidate is one address/port pair worth trying a connectivity check
+// against, along with an ICE-style priority used to order the checks.
+type Candidate struct {
+	IP       net.IP
+	Port     int
+	Type     CandidateType
+	Priority uint32
+}
+
+// candidatePriority follows the ICE preference order: host first (cheapest
+// and most likely same-LAN), then server-reflexive, then relayed.
+func candidatePriority(t CandidateType, localPref uint32) uint32 {
+	var typePref uint32
+	switch t {
+	case CandidateHost:
+		typePref = 126
+	case CandidateServerReflexive:
+		typePref = 100
+	case CandidateRelay:
+		typePref = 0
+	}
+	return typePref<<24 | localPref<<8
+}
+
+// CandidateGatherer collects every address this host might be reachable on:
+// host addresses from local interfaces, a server-reflexive address learned
+// from STUN, and a port-mapped address when a PortMapper succeeded.
+type CandidateGatherer struct {
+	stunServers []string
+	portMappers []PortMapper
+	localPort   int
+
+	mappingMu       sync.Mutex
+	mappingReleases []func()
+}
+
+// NewCandidateGatherer creates a gatherer that probes the given STUN servers
+// and port mappers for additional candidates on top of host addresses.
+func NewCandidateGatherer(stunServers []string, portMappers []PortMapper, localPort int) *CandidateGatherer {
+	return &CandidateGatherer{
+		stunServers: stunServers,
+		portMappers: portMappers,
+		localPort:   localPort,
+	}
+}
+
+// Gather returns every candidate it could collect, sorted highest priority first.
+func (g *CandidateGatherer) Gather() ([]Candidate, error) {
+	var candidates []Candidate
+
+	hostCandidates, err := g.hostCandidates()
+	if err != nil {
+		log.Warn(prefix, "failed to enumerate host candidates: ", err)
+	}
+	candidates = append(candidates, hostCandidates...)
+
+	if srflx, err := g.reflexiveCandidate(); err == nil {
+		candidates = append(candidates, srflx)
+	} else {
+		log.Debug(prefix, "no server-reflexive candidate: ", err)
+	}
+
+	if relay, err := g.relayCandidate(); err == nil {
+		candidates = append(candidates, relay)
+	} else {
+		log.Debug(prefix, "no port-mapped candidate: ", err)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Priority > candidates[j].Priority
+	})
+
+	return candidates, nil
+}
+
+func (g *CandidateGatherer) hostCandidates() ([]Candidate, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []Candidate
+	for i, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.To4() == nil {
+			continue
+		}
+		candidates = append(candidates, Candidate{
+			IP:       ipNet.IP,
+			Port:     g.localPort,
+			Type:     CandidateHost,
+			Priority: candidatePriority(CandidateHost, uint32(i)),
+		})
+	}
+	return candidates, nil
+}
+
+func (g *CandidateGatherer) reflexiveCandidate() (Candidate, error) {
+	var lastErr error
+	for _, server := range g.stunServers {
+		ip, port, err := stunBindingRequest(server, g.localPort)
+		if err == nil {
+			return Candidate{
+				IP:       ip,
+				Port:     port,
+				Type:     CandidateServerReflexive,
+				Priority: candidatePriority(CandidateServerReflexive, 0),
+			}, nil
+		}
+		lastErr = err
+	}
+	return Candidate{}, lastErr
+}
+
+func (g *CandidateGatherer) relayCandidate() (Candidate, error) {
+	ip, port, stop, err := mapPort(g.portMappers, "udp", g.localPort)
+	if err != nil {
+		return Candidate{}, err
+	}
+
+	g.mappingMu.Lock()
+	g.mappingReleases = append(g.mappingReleases, stop)
+	g.mappingMu.Unlock()
+
+	return Candidate{
+		IP:       ip,
+		Port:     port,
+		Type:     CandidateRelay,
+		Priority: candidatePriority(CandidateRelay, 0),
+	}, nil
+}
+
+// Close releases every port mapping lease obtained while gathering
+// candidates. Callers should invoke it once the candidates are no longer
+// needed - e.g. the session that advertised them has ended - so the
+// mappings' lease refresher goroutines don't outlive their purpose.
+func (g *CandidateGatherer) Close() {
+	g.mappingMu.Lock()
+	defer g.mappingMu.Unlock()
+
+	for _, stop := range g.mappingReleases {
+		stop()
+	}
+	g.mappingReleases = nil
+}
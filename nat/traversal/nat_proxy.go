@@ -0,0 +1,103 @@
+/*
+ * Copyright (C) 2019 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package traversal
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"github.com/mysteriumnetwork/node/services"
+)
+
+// NATProxy is the natProxy implementation Pinger hands a punched-through or
+// relayed connection off to. It doesn't care how the connection to the
+// provider was established - a direct TTL punch and a relay fallback both
+// end up calling handOff/handOffRelay - it only needs to know which local
+// port the consumer-side service for serviceType is already listening on.
+type NATProxy struct {
+	mu    sync.Mutex
+	ports map[services.ServiceType]int
+}
+
+// NewNATProxy returns a NATProxy with no services registered yet; callers
+// must BindServicePort (via Pinger.BindServicePort) before a handOff for
+// that serviceType can succeed.
+func NewNATProxy() *NATProxy {
+	return &NATProxy{ports: make(map[services.ServiceType]int)}
+}
+
+// registerServicePort records the local port serviceType's consumer-side
+// process is listening on.
+func (p *NATProxy) registerServicePort(serviceType services.ServiceType, port int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ports[serviceType] = port
+}
+
+// isAvailable reports whether serviceType has a local port registered.
+func (p *NATProxy) isAvailable(serviceType services.ServiceType) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.ports[serviceType]
+	return ok
+}
+
+// handOff splices conn - a connection that reached the provider via a
+// direct NAT punch - with the local service registered for serviceType.
+func (p *NATProxy) handOff(serviceType services.ServiceType, conn net.Conn) {
+	p.pipeToLocalService(serviceType, conn)
+}
+
+// handOffRelay does the same as handOff for a connection that reached the
+// provider through the relay fallback instead - from here on the two are
+// indistinguishable to the local service.
+func (p *NATProxy) handOffRelay(serviceType services.ServiceType, relayConn net.Conn) {
+	p.pipeToLocalService(serviceType, relayConn)
+}
+
+func (p *NATProxy) pipeToLocalService(serviceType services.ServiceType, conn net.Conn) {
+	defer conn.Close()
+
+	p.mu.Lock()
+	port, ok := p.ports[serviceType]
+	p.mu.Unlock()
+	if !ok {
+		log.Warn(prefix, "no local service registered for ", serviceType, ", dropping handed-off connection")
+		return
+	}
+
+	local, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		log.Error(prefix, "failed to reach local ", serviceType, " service: ", err)
+		return
+	}
+	defer local.Close()
+
+	done := make(chan struct{}, 2)
+	go copyAndSignal(local, conn, done)
+	go copyAndSignal(conn, local, done)
+	<-done
+}
+
+func copyAndSignal(dst io.Writer, src io.Reader, done chan<- struct{}) {
+	io.Copy(dst, src)
+	done <- struct{}{}
+}
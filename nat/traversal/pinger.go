@@ -18,6 +18,8 @@
 package traversal
 
 import (
+	"crypto/ed25519"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -38,24 +40,59 @@ const pingTimeout = 10000
 
 // Pinger represents NAT pinger structure
 type Pinger struct {
-	pingTarget     chan *Params
-	pingCancelled  chan struct{}
-	natEventWaiter NatEventWaiter
-	configParser   ConfigParser
-	once           sync.Once
-	natProxy       natProxy
-	portPool       portSupplier
-	consumerPort   int
+	pingTarget      chan *Params
+	pingCancelled   chan struct{}
+	natEventWaiter  NatEventWaiter
+	eventPublisher  NatEventPublisher
+	configParser    ConfigParser
+	once            sync.Once
+	natProxy        natProxy
+	portPool        portSupplier
+	consumerPort    int
+	portMappers     []PortMapper
+	portMappingStop func()
+	stunServers     []string
+	identity        ed25519.PrivateKey
+	relayDialer     RelayDialer
+	brokerAddr      string
+	dial            dialFunc
+
+	pendingMu    sync.Mutex
+	pendingPings map[[32]byte]pendingPing
 }
 
+// defaultSTUNServers is used to learn our server-reflexive candidate when
+// BindSTUNServers hasn't overridden it.
+var defaultSTUNServers = []string{"stun.l.google.com:19302", "stun1.l.google.com:19302"}
+
+// pendingPing records a ping we sent and are still waiting to be answered,
+// so pingReceiver can reject a pong that doesn't correspond to one of our
+// own outstanding pings and can pin the answer to the peer we actually
+// expect it from.
+type pendingPing struct {
+	peerPubKey ed25519.PublicKey
+	expires    time.Time
+}
+
+// dialFunc opens the connection a ping attempt is sent over. Swappable so
+// the traversal/simulation harness can inject in-process virtual NAT boxes
+// instead of real UDP sockets.
+type dialFunc func(ip string, port int, pingerPort int) (net.Conn, error)
+
 // NatEventWaiter is responsible for waiting for nat events
 type NatEventWaiter interface {
 	WaitForEvent() Event
 }
 
+// NatEventPublisher publishes Pinger lifecycle events (e.g. a successful
+// gateway port mapping), the same Event/EventType NatEventWaiter waits on.
+type NatEventPublisher interface {
+	Publish(Event)
+}
+
 // ConfigParser is able to parse a config from given raw json
 type ConfigParser interface {
-	Parse(config json.RawMessage) (ip string, port int, serviceType services.ServiceType, err error)
+	Parse(config json.RawMessage) (candidates []Candidate, serviceType services.ServiceType, err error)
 }
 
 type portSupplier interface {
@@ -63,29 +100,53 @@ type portSupplier interface {
 }
 
 // NewPingerFactory returns Pinger instance
-func NewPingerFactory(waiter NatEventWaiter, parser ConfigParser, proxy natProxy, portPool portSupplier) *Pinger {
+func NewPingerFactory(waiter NatEventWaiter, publisher NatEventPublisher, parser ConfigParser, proxy natProxy, portPool portSupplier) *Pinger {
+	return newPinger(waiter, publisher, parser, proxy, portPool, dialUDP)
+}
+
+// NewSimulatedPingerFactory returns a Pinger that punches through dial
+// instead of real UDP sockets, so NAT scenarios from traversal/simulation
+// can be exercised deterministically, without touching the network.
+func NewSimulatedPingerFactory(waiter NatEventWaiter, publisher NatEventPublisher, parser ConfigParser, proxy natProxy, portPool portSupplier, dial dialFunc) *Pinger {
+	return newPinger(waiter, publisher, parser, proxy, portPool, dial)
+}
+
+func newPinger(waiter NatEventWaiter, publisher NatEventPublisher, parser ConfigParser, proxy natProxy, portPool portSupplier, dial dialFunc) *Pinger {
 	target := make(chan *Params)
 	cancel := make(chan struct{})
 	return &Pinger{
 		pingTarget:     target,
 		pingCancelled:  cancel,
 		natEventWaiter: waiter,
+		eventPublisher: publisher,
 		configParser:   parser,
 		natProxy:       proxy,
 		portPool:       portPool,
+		portMappers:    defaultPortMappers(),
+		relayDialer:    NewRelayDialer(),
+		dial:           dial,
+		stunServers:    defaultSTUNServers,
+		pendingPings:   make(map[[32]byte]pendingPing),
 	}
 }
 
 type natProxy interface {
-	handOff(serviceType services.ServiceType, conn *net.UDPConn)
+	handOff(serviceType services.ServiceType, conn net.Conn)
+	handOffRelay(serviceType services.ServiceType, relayConn net.Conn)
 	registerServicePort(serviceType services.ServiceType, port int)
 	isAvailable(serviceType services.ServiceType) bool
 }
 
-// Params contains session parameters needed to NAT ping remote peer
+// Params contains session parameters needed to NAT ping remote peer.
+// RequestConfig carries the remote peer's gathered candidates (host,
+// server-reflexive and port-mapped), ordered by decreasing ICE priority.
 type Params struct {
 	RequestConfig json.RawMessage
 	Port          int
+	PeerID        string
+	PeerPubKey    ed25519.PublicKey
+	SessionID     string
+	SharedSecret  string
 }
 
 // Start starts NAT pinger and waits for PingTarget to ping
@@ -97,12 +158,25 @@ func (p *Pinger) Start() {
 		return
 	}
 
+	// Before falling back to TTL-based UDP hole punching, try to get a public
+	// port forwarded by the gateway itself - no punching needed if it works.
+	// The mapping's lease refresher keeps running until Stop releases it, and
+	// PingTarget keeps being served below regardless of the outcome, since a
+	// mapped port doesn't relieve us from handing off future sessions.
+	if externalIP, externalPort, stop, err := mapPort(p.portMappers, "udp", p.consumerPort); err == nil {
+		log.Info(prefix, "obtained port mapping ", externalIP, ":", externalPort, " via gateway")
+		p.portMappingStop = stop
+		p.publishEvent(Event{Type: SuccessEventType, IP: externalIP.String(), Port: externalPort})
+	} else {
+		log.Debug(prefix, "port mapping unavailable, falling back to TTL hole punching: ", err)
+	}
+
 	for {
 		select {
 		case pingParams := <-p.pingTarget:
 			log.Info(prefix, "Pinging peer with", pingParams)
 
-			IP, port, serviceType, err := p.configParser.Parse(pingParams.RequestConfig)
+			candidates, serviceType, err := p.configParser.Parse(pingParams.RequestConfig)
 			if err != nil {
 				log.Warn(prefix, errors.Wrap(err, fmt.Sprintf("unable to parse ping message: %v", pingParams)))
 			}
@@ -112,27 +186,18 @@ func (p *Pinger) Start() {
 				continue
 			}
 
-			log.Infof("%sping target received: IP: %v, port: %v", prefix, IP, port)
-			if port == 0 {
-				// client did not sent its port to ping to, notifying the service to start
-				continue
-			}
-			conn, err := p.getConnection(IP, port, pingParams.Port)
-			if err != nil {
-				log.Error(prefix, "failed to get connection: ", err)
+			log.Infof("%sping target received: %d candidate(s)", prefix, len(candidates))
+			if len(candidates) == 0 {
+				// client did not send any candidates to ping to, notifying the service to start
 				continue
 			}
 
-			go func() {
-				err := p.ping(conn)
-				if err != nil {
-					log.Warn(prefix, "Error while pinging: ", err)
-				}
-			}()
-
-			err = p.pingReceiver(conn)
+			conn, err := p.raceCandidates(candidates, pingParams.Port, pingParams.PeerPubKey)
 			if err != nil {
-				log.Error(prefix, "ping receiver error: ", err)
+				log.Warn(prefix, "connectivity check against every candidate failed, falling back to relay: ", err)
+				if relayErr := p.relayFallback(serviceType, p.brokerAddr, pingParams.PeerID, pingParams.SessionID, pingParams.SharedSecret); relayErr != nil {
+					log.Error(prefix, "relay fallback failed: ", relayErr)
+				}
 				continue
 			}
 
@@ -143,13 +208,27 @@ func (p *Pinger) Start() {
 	}
 }
 
-// Stop noop method
+// Stop releases any gateway port mapping still held. NATPinger itself
+// should not stop - Start's serving loop keeps running for the process's
+// lifetime.
 func (p *Pinger) Stop() {
-	// noop method - NATPinger should not stop
+	if p.portMappingStop != nil {
+		p.portMappingStop()
+	}
+}
+
+func (p *Pinger) publishEvent(event Event) {
+	if p.eventPublisher == nil {
+		return
+	}
+	p.eventPublisher.Publish(event)
 }
 
-// PingProvider pings provider determined by destination provided in sessionConfig
-func (p *Pinger) PingProvider(ip string, port int) error {
+// PingProvider pings provider determined by destination provided in sessionConfig.
+// peerPubKey pins the identity a pong (or an unsolicited ping) must be signed
+// by for the punch to be accepted - without it, any host on the path could
+// forge a "ping received" and get handed a bogus connection.
+func (p *Pinger) PingProvider(ip string, port int, peerPubKey ed25519.PublicKey) error {
 	log.Info(prefix, "NAT pinging to provider")
 
 	conn, err := p.getConnection(ip, port, p.consumerPort)
@@ -158,15 +237,21 @@ func (p *Pinger) PingProvider(ip string, port int) error {
 	}
 	defer conn.Close()
 
+	ping, err := newPing(p.identity)
+	if err != nil {
+		return errors.Wrap(err, "failed to prepare signed ping")
+	}
+	p.registerPing(ping, peerPubKey)
+
 	go func() {
-		err := p.ping(conn)
+		err := p.ping(conn, ping, p.pingCancelled)
 		if err != nil {
 			log.Warn(prefix, "Error while pinging: ", err)
 		}
 	}()
 
 	time.Sleep(pingInterval * time.Millisecond)
-	err = p.pingReceiver(conn)
+	err = p.pingReceiver(conn, ping, peerPubKey, p.pingCancelled)
 	if err != nil {
 		return err
 	}
@@ -177,12 +262,122 @@ func (p *Pinger) PingProvider(ip string, port int) error {
 	return nil
 }
 
-func (p *Pinger) ping(conn *net.UDPConn) error {
+// registerPing remembers that ping is outstanding and which peer's signature
+// a pong answering it must carry, so pingReceiver can reject pongs that
+// don't match a ping we actually sent. Entries expire after pingTimeout so a
+// pong that shows up late (or never) doesn't linger in the map forever.
+func (p *Pinger) registerPing(ping Ping, peerPubKey ed25519.PublicKey) {
+	tokenHash := sha256.Sum256(ping.Token[:])
+
+	p.pendingMu.Lock()
+	defer p.pendingMu.Unlock()
+
+	now := time.Now()
+	for token, pending := range p.pendingPings {
+		if now.After(pending.expires) {
+			delete(p.pendingPings, token)
+		}
+	}
+
+	p.pendingPings[tokenHash] = pendingPing{
+		peerPubKey: peerPubKey,
+		expires:    now.Add(pingTimeout * time.Millisecond),
+	}
+}
+
+// consumePendingPong looks up, and removes, the pending ping that pong
+// answers, returning the peer public key a valid signature must be under.
+// It fails closed: an unknown or expired token is treated the same as no
+// match at all.
+func (p *Pinger) consumePendingPong(pong Pong) (ed25519.PublicKey, bool) {
+	p.pendingMu.Lock()
+	defer p.pendingMu.Unlock()
+
+	pending, ok := p.pendingPings[pong.TokenHash]
+	delete(p.pendingPings, pong.TokenHash)
+	if !ok || time.Now().After(pending.expires) {
+		return nil, false
+	}
+	return pending.peerPubKey, true
+}
+
+// raceCandidates runs a connectivity check against every candidate in
+// parallel and returns the connection for whichever one punches through
+// first. It waits for every check to finish before returning: the other
+// checks are not cancelled, each runs until it succeeds or times out, and
+// any later connection that succeeds is closed. Candidates are already
+// ordered by decreasing ICE priority, but since checks run concurrently the
+// fastest one wins.
+func (p *Pinger) raceCandidates(candidates []Candidate, pingerPort int, peerPubKey ed25519.PublicKey) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+
+	results := make(chan result, len(candidates))
+	for _, candidate := range candidates {
+		go func(candidate Candidate) {
+			cancel := make(chan struct{})
+			conn, err := p.checkCandidate(candidate, pingerPort, peerPubKey, cancel)
+			results <- result{conn, err}
+		}(candidate)
+	}
+
+	var lastErr error
+	var winner net.Conn
+	for range candidates {
+		r := <-results
+		if r.err != nil {
+			lastErr = r.err
+			continue
+		}
+		if winner == nil {
+			winner = r.conn
+		} else {
+			r.conn.Close()
+		}
+	}
+
+	if winner == nil {
+		return nil, errors.Wrap(lastErr, "no candidate was reachable")
+	}
+	return winner, nil
+}
+
+func (p *Pinger) checkCandidate(candidate Candidate, pingerPort int, peerPubKey ed25519.PublicKey, cancel chan struct{}) (net.Conn, error) {
+	conn, err := p.getConnection(candidate.IP.String(), candidate.Port, pingerPort)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get connection")
+	}
+
+	ping, err := newPing(p.identity)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to prepare signed ping")
+	}
+	p.registerPing(ping, peerPubKey)
+
+	go func() {
+		if err := p.ping(conn, ping, cancel); err != nil {
+			log.Warn(prefix, "Error while pinging candidate ", candidate.IP, ":", candidate.Port, ": ", err)
+		}
+	}()
+
+	if err := p.pingReceiver(conn, ping, peerPubKey, cancel); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (p *Pinger) ping(conn net.Conn, ping Ping, cancel chan struct{}) error {
 	n := 1
+	payload := marshalPing(ping)
 
 	for {
 		select {
-		case <-p.pingCancelled:
+		case <-cancel:
 			return nil
 
 		case <-time.After(pingInterval * time.Millisecond):
@@ -196,14 +391,14 @@ func (p *Pinger) ping(conn *net.UDPConn) error {
 				n = 128
 			}
 
-			err := ipv4.NewConn(conn).SetTTL(n)
+			err := setTTL(conn, n)
 			if err != nil {
 				return errors.Wrap(err, "pinger setting ttl failed")
 			}
 
 			n++
 
-			_, err = conn.Write([]byte("continuously pinging to " + conn.RemoteAddr().String()))
+			_, err = conn.Write(payload)
 			if err != nil {
 				return err
 			}
@@ -211,7 +406,28 @@ func (p *Pinger) ping(conn *net.UDPConn) error {
 	}
 }
 
-func (p *Pinger) getConnection(ip string, port int, pingerPort int) (*net.UDPConn, error) {
+// ttlSetter is implemented by connections that know how to set their own IP
+// TTL without going through ipv4.NewConn - namely the in-process pipes the
+// traversal/simulation harness dials, which have no real socket to control.
+type ttlSetter interface {
+	SetTTL(ttl int) error
+}
+
+func setTTL(conn net.Conn, ttl int) error {
+	if setter, ok := conn.(ttlSetter); ok {
+		return setter.SetTTL(ttl)
+	}
+	return ipv4.NewConn(conn).SetTTL(ttl)
+}
+
+func (p *Pinger) getConnection(ip string, port int, pingerPort int) (net.Conn, error) {
+	return p.dial(ip, port, pingerPort)
+}
+
+// dialUDP is the default dialFunc: a real UDP socket. Tests and the
+// traversal/simulation harness substitute their own dialFunc to punch
+// through in-process, deterministic virtual NAT boxes instead.
+func dialUDP(ip string, port int, pingerPort int) (net.Conn, error) {
 	udpAddr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", ip, port))
 	if err != nil {
 		return nil, err
@@ -244,12 +460,73 @@ func (p *Pinger) BindServicePort(serviceType services.ServiceType, port int) {
 	p.natProxy.registerServicePort(serviceType, port)
 }
 
-func (p *Pinger) pingReceiver(conn *net.UDPConn) error {
+// BindIdentity sets the Ed25519 identity key used to sign and verify
+// ping/pong messages, so a punch can't be spoofed or reflected off-path.
+func (p *Pinger) BindIdentity(priv ed25519.PrivateKey) {
+	p.identity = priv
+}
+
+// BindBrokerAddr sets the address of the already-reachable node used as a
+// relay of last resort when symmetric NAT defeats every direct candidate.
+func (p *Pinger) BindBrokerAddr(addr string) {
+	p.brokerAddr = addr
+}
+
+// BindSTUNServers overrides the STUN servers used to learn our
+// server-reflexive candidate in GatherCandidates.
+func (p *Pinger) BindSTUNServers(servers []string) {
+	p.stunServers = servers
+}
+
+// GatherCandidates collects every address this pinger might be reachable on
+// - host, server-reflexive and port-mapped - for advertising to a peer ahead
+// of a NAT punch attempt. The returned CandidateGatherer should be Close'd
+// once the candidates it produced are no longer needed, to release any port
+// mapping lease it obtained.
+func (p *Pinger) GatherCandidates() ([]Candidate, *CandidateGatherer, error) {
+	gatherer := NewCandidateGatherer(p.stunServers, p.portMappers, p.consumerPort)
+	candidates, err := gatherer.Gather()
+	if err != nil {
+		gatherer.Close()
+		return nil, nil, err
+	}
+	return candidates, gatherer, nil
+}
+
+// requestConfig is the wire format PrepareConfig produces and ConfigParser.Parse
+// is expected to decode on the receiving side.
+type requestConfig struct {
+	Candidates  []Candidate
+	ServiceType services.ServiceType
+}
+
+// PrepareConfig gathers this pinger's candidates and serializes them into the
+// RequestConfig a consumer advertises to the provider over signaling ahead of
+// a session - the mirror of configParser.Parse, which decodes it back out on
+// the provider side once PingTarget hands the session to Start's serving
+// loop. Callers must Close the returned CandidateGatherer once the session
+// that advertised its candidates has ended.
+func (p *Pinger) PrepareConfig(serviceType services.ServiceType) (json.RawMessage, *CandidateGatherer, error) {
+	candidates, gatherer, err := p.GatherCandidates()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to gather candidates")
+	}
+
+	config, err := json.Marshal(requestConfig{Candidates: candidates, ServiceType: serviceType})
+	if err != nil {
+		gatherer.Close()
+		return nil, nil, errors.Wrap(err, "failed to marshal request config")
+	}
+
+	return config, gatherer, nil
+}
+
+func (p *Pinger) pingReceiver(conn net.Conn, ours Ping, peerPubKey ed25519.PublicKey, cancel chan struct{}) error {
 	timeout := time.After(pingTimeout * time.Millisecond)
 	for {
 		select {
 		case <-timeout:
-			p.pingCancelled <- struct{}{}
+			cancel <- struct{}{}
 			return errors.New("NAT punch attempt timed out")
 		default:
 		}
@@ -261,13 +538,52 @@ func (p *Pinger) pingReceiver(conn *net.UDPConn) error {
 			time.Sleep(pingInterval * time.Millisecond)
 			continue
 		}
-		fmt.Println("remote peer data received: ", string(buf[:n]))
+		data := buf[:n]
+
+		switch {
+		case isPongMessage(data):
+			pong, err := unmarshalPong(data)
+			if err != nil {
+				log.Warn(prefix, "dropping unparseable pong")
+				continue
+			}
+			expectedPeer, ok := p.consumePendingPong(pong)
+			if !ok {
+				log.Warn(prefix, "dropping pong with no matching outstanding ping (unknown or expired)")
+				continue
+			}
+			if !pong.verifyFor(ours, expectedPeer) {
+				log.Warn(prefix, "dropping pong that fails signature check against expected peer")
+				continue
+			}
+			log.Info(prefix, "verified pong received from: ", conn.RemoteAddr().String())
+
+		case isPingMessage(data):
+			theirs, err := unmarshalPing(data)
+			if err != nil || !theirs.verifyFrom(peerPubKey) {
+				log.Warn(prefix, "dropping ping with an invalid or unexpected signature from: ", conn.RemoteAddr().String())
+				continue
+			}
+			pong, err := theirs.answer(p.identity)
+			if err != nil {
+				log.Error(prefix, "failed to sign pong: ", err)
+				continue
+			}
+			if _, err := conn.Write(marshalPong(pong)); err != nil {
+				log.Error(prefix, "failed to send pong: ", err)
+			}
+			continue
+
+		default:
+			log.Warn(prefix, "dropping unrecognised datagram from: ", conn.RemoteAddr().String())
+			continue
+		}
 
 		// send another couple of pings to remote side, because only now we have a pinghole
 		// or wait for your pings to reach other end before closing pinger conn.
 		select {
 		case <-time.After(2 * pingInterval * time.Millisecond):
-			p.pingCancelled <- struct{}{}
+			cancel <- struct{}{}
 			return nil
 		}
 	}
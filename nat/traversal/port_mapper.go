@@ -0,0 +1,108 @@
+/*
+ * Copyright (C) 2019 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package traversal
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+)
+
+const mappingLeaseDuration = 60 * time.Minute
+const mappingRefreshMargin = 5 * time.Minute
+
+// PortMapper requests a publicly reachable port from the local gateway, either
+// via UPnP IGD or NAT-PMP/PCP, and keeps the lease alive for as long as it's held.
+type PortMapper interface {
+	// Map asks the gateway to forward externalIP:externalPort to our internalPort
+	// for the given protocol ("udp" or "tcp"), leasing the mapping for ttl.
+	Map(protocol string, internalPort int, ttl time.Duration) (externalIP net.IP, externalPort int, err error)
+}
+
+// portMapping describes an active lease so it can be renewed or released.
+type portMapping struct {
+	mapper       PortMapper
+	protocol     string
+	internalPort int
+	externalIP   net.IP
+	externalPort int
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// mapPort attempts to obtain a forwarded public port for internalPort, trying
+// UPnP IGD first and falling back to NAT-PMP/PCP. A refresher goroutine keeps
+// renewing the lease until the returned stop func is called.
+func mapPort(mappers []PortMapper, protocol string, internalPort int) (externalIP net.IP, externalPort int, stop func(), err error) {
+	var lastErr error
+	for _, mapper := range mappers {
+		externalIP, externalPort, lastErr = mapper.Map(protocol, internalPort, mappingLeaseDuration)
+		if lastErr == nil {
+			mapping := &portMapping{
+				mapper:       mapper,
+				protocol:     protocol,
+				internalPort: internalPort,
+				externalIP:   externalIP,
+				externalPort: externalPort,
+				stop:         make(chan struct{}),
+			}
+			go mapping.refresh()
+			return externalIP, externalPort, mapping.release, nil
+		}
+		log.Debug(prefix, "port mapper ", mapper, " failed: ", lastErr)
+	}
+	return nil, 0, nil, errors.Wrap(lastErr, "no port mapper succeeded")
+}
+
+func (m *portMapping) refresh() {
+	ticker := time.NewTicker(mappingLeaseDuration - mappingRefreshMargin)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			ip, port, err := m.mapper.Map(m.protocol, m.internalPort, mappingLeaseDuration)
+			if err != nil {
+				log.Warn(prefix, "failed to refresh port mapping lease: ", err)
+				continue
+			}
+			m.externalIP, m.externalPort = ip, port
+			log.Debug(prefix, "port mapping lease refreshed: ", ip, ":", port)
+		}
+	}
+}
+
+func (m *portMapping) release() {
+	m.once.Do(func() {
+		close(m.stop)
+	})
+}
+
+// defaultPortMappers returns the port mappers tried by the Pinger, in priority order.
+func defaultPortMappers() []PortMapper {
+	return []PortMapper{
+		&upnpPortMapper{},
+		&natPMPPortMapper{},
+	}
+}
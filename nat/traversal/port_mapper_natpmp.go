@@ -0,0 +1,72 @@
+/*
+ * Copyright (C) 2019 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package traversal
+
+import (
+	"net"
+	"time"
+
+	"github.com/jackpal/gateway"
+	natpmp "github.com/jackpal/go-nat-pmp"
+	"github.com/pkg/errors"
+)
+
+// natPMPGateway is the conventional multicast group used by NAT-PMP/PCP
+// announcements. Nothing in this package sends to it; requests go to the
+// gateway that defaultGateway finds.
+const natPMPGateway = "224.0.0.1:5351"
+
+// natPMPPortMapper requests a mapping from the default gateway using the
+// NAT-PMP protocol, falling back target for routers that don't speak UPnP.
+type natPMPPortMapper struct{}
+
+func (m *natPMPPortMapper) Map(protocol string, internalPort int, ttl time.Duration) (net.IP, int, error) {
+	gatewayIP, err := defaultGateway()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "could not determine default gateway")
+	}
+
+	client := natpmp.NewClient(gatewayIP)
+
+	externalAddr, err := client.GetExternalAddress()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "NAT-PMP GetExternalAddress failed")
+	}
+
+	result, err := client.AddPortMapping(protocol, internalPort, internalPort, int(ttl.Seconds()))
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "NAT-PMP AddPortMapping failed")
+	}
+
+	return net.IP(externalAddr.ExternalIPAddress[:]), int(result.MappedExternalPort), nil
+}
+
+// defaultGateway returns the router that owns the host's default route, which
+// NAT-PMP/PCP requests are addressed to directly (rather than natPMPGateway,
+// which this package does not use). Guessing the
+// gateway from our own address (e.g. assuming x.x.x.1) is wrong on a large
+// fraction of real networks, so read the actual default route the same way
+// gateway.DiscoverGateway does per-OS (/proc/net/route on Linux, a route
+// socket on BSD/Darwin, the IP Helper API on Windows).
+func defaultGateway() (net.IP, error) {
+	gatewayIP, err := gateway.DiscoverGateway()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not discover default gateway")
+	}
+	return gatewayIP, nil
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (C) 2019 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package traversal
+
+import (
+	"net"
+	"time"
+
+	"github.com/huin/goupnp/dcps/internetgateway2"
+	"github.com/pkg/errors"
+)
+
+// upnpPortMapper discovers an Internet Gateway Device over SSDP and requests
+// a WANIPConnection1 port mapping, miniupnpc-style; gateways that only offer
+// WANPPPConnection are not queried.
+type upnpPortMapper struct{}
+
+func (m *upnpPortMapper) Map(protocol string, internalPort int, ttl time.Duration) (net.IP, int, error) {
+	clients, _, err := internetgateway2.NewWANIPConnection1Clients()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "UPnP discovery failed")
+	}
+	if len(clients) == 0 {
+		return nil, 0, errors.New("no UPnP IGD found on the network")
+	}
+	client := clients[0]
+
+	externalIP, err := client.GetExternalIPAddress()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to fetch external IP from IGD")
+	}
+
+	externalPort := uint16(internalPort)
+	err = client.AddPortMapping(
+		"", externalPort, upnpProtocol(protocol), uint16(internalPort), localIP().String(),
+		true, "myst node", uint32(ttl.Seconds()),
+	)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "AddPortMapping failed")
+	}
+
+	return net.ParseIP(externalIP), int(externalPort), nil
+}
+
+func upnpProtocol(protocol string) string {
+	if protocol == "tcp" {
+		return "TCP"
+	}
+	return "UDP"
+}
+
+func localIP() net.IP {
+	conn, err := net.Dial("udp", "8.8.8.8:80")
+	if err != nil {
+		return net.IPv4zero
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
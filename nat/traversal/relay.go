@@ -0,0 +1,216 @@
+/*
+ * Copyright (C) 2019 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package traversal
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/hashicorp/yamux"
+	"github.com/mysteriumnetwork/node/services"
+	"github.com/pkg/errors"
+)
+
+const relayDialTimeout = 10 * time.Second
+const relayAckTimeout = 10 * time.Second
+
+// NewVisitorConn is the control-protocol request a consumer sends over the
+// already-reachable relay connection, asking it to splice a relayed stream
+// between itself and peerID for the given session. Modeled on frp's XTCP
+// visitor handshake. SharedSecret lets the broker authenticate the request,
+// but only because the control connection it's sent over is TLS - sent in
+// the clear, it would just be handing a replayable credential to anyone
+// watching traffic to the broker, not just anyone who could reach its port.
+type NewVisitorConn struct {
+	PeerID       string `json:"peer_id"`
+	SessionID    string `json:"session_id"`
+	SharedSecret string `json:"shared_secret"`
+}
+
+// visitorConnAck is the broker's reply to a NewVisitorConn request, modeled
+// on frp's StartWorkConn acknowledgment. Without waiting for it, a rejected
+// or invalid request would be handed off as if the relay had been set up.
+type visitorConnAck struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// RelayDialer opens a relayed connection to peerID through an already
+// reachable broker/provider node, for use when both sides are behind a
+// symmetric NAT and no direct candidate could be punched through.
+type RelayDialer interface {
+	DialRelay(brokerAddr, peerID, sessionID, sharedSecret string) (net.Conn, error)
+}
+
+// yamuxRelayDialer opens a new TLS control connection and yamux session to
+// the broker on every DialRelay call and carries the visitor session on one
+// stream of it; control connections are not kept or shared between sessions.
+type yamuxRelayDialer struct{}
+
+// NewRelayDialer returns the default RelayDialer implementation.
+func NewRelayDialer() RelayDialer {
+	return &yamuxRelayDialer{}
+}
+
+func (d *yamuxRelayDialer) DialRelay(brokerAddr, peerID, sessionID, sharedSecret string) (net.Conn, error) {
+	rawConn, err := net.DialTimeout("tcp", brokerAddr, relayDialTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to dial relay broker")
+	}
+
+	conn, err := tlsDialRelay(rawConn, brokerAddr)
+	if err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+
+	session, err := yamux.Client(conn, nil)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to open relay control session")
+	}
+
+	stream, err := session.Open()
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to open relay visitor stream")
+	}
+
+	request := NewVisitorConn{PeerID: peerID, SessionID: sessionID, SharedSecret: sharedSecret}
+	if err := json.NewEncoder(stream).Encode(request); err != nil {
+		stream.Close()
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to send visitor request")
+	}
+
+	if err := stream.SetReadDeadline(time.Now().Add(relayAckTimeout)); err != nil {
+		stream.Close()
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to set visitor ack deadline")
+	}
+	var ack visitorConnAck
+	if err := json.NewDecoder(stream).Decode(&ack); err != nil {
+		stream.Close()
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to read visitor ack")
+	}
+	if !ack.OK {
+		stream.Close()
+		conn.Close()
+		return nil, errors.Errorf("broker rejected relay session: %s", ack.Error)
+	}
+	if err := stream.SetReadDeadline(time.Time{}); err != nil {
+		stream.Close()
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to clear visitor ack deadline")
+	}
+
+	log.Info(prefix, "relay visitor connection established with peer ", peerID, " via ", brokerAddr)
+
+	// yamux.Stream is a reliable byte stream with no message boundaries -
+	// framing it preserves WireGuard's UDP datagram boundaries, which would
+	// otherwise corrupt the moment two packets land back-to-back on one Read.
+	return newFrameConn(stream), nil
+}
+
+// tlsDialRelay upgrades rawConn to TLS against brokerAddr's hostname,
+// verifying the broker's certificate the normal way - without this, the
+// SharedSecret every NewVisitorConn request carries would cross the wire in
+// the clear, letting anyone observing traffic to the broker (not just
+// anyone able to reach its port) capture it on the first use and replay it.
+func tlsDialRelay(rawConn net.Conn, brokerAddr string) (*tls.Conn, error) {
+	host, _, err := net.SplitHostPort(brokerAddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid relay broker address")
+	}
+
+	conn := tls.Client(rawConn, &tls.Config{ServerName: host})
+	if err := conn.SetDeadline(time.Now().Add(relayDialTimeout)); err != nil {
+		return nil, errors.Wrap(err, "failed to set relay TLS handshake deadline")
+	}
+	if err := conn.Handshake(); err != nil {
+		return nil, errors.Wrap(err, "relay broker TLS handshake failed")
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, errors.Wrap(err, "failed to clear relay TLS handshake deadline")
+	}
+
+	return conn, nil
+}
+
+// frameConn adapts a reliable, stream-oriented net.Conn to a
+// datagram-oriented one by length-prefixing every Write and reading exactly
+// one such frame per Read.
+type frameConn struct {
+	net.Conn
+}
+
+func newFrameConn(conn net.Conn) net.Conn {
+	return &frameConn{Conn: conn}
+}
+
+func (f *frameConn) Write(b []byte) (int, error) {
+	if len(b) > 0xFFFF {
+		return 0, errors.New("datagram too large to frame over relay stream")
+	}
+
+	var header [2]byte
+	binary.BigEndian.PutUint16(header[:], uint16(len(b)))
+	if _, err := f.Conn.Write(header[:]); err != nil {
+		return 0, err
+	}
+	if _, err := f.Conn.Write(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (f *frameConn) Read(b []byte) (int, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(f.Conn, header[:]); err != nil {
+		return 0, err
+	}
+
+	n := int(binary.BigEndian.Uint16(header[:]))
+	if n > len(b) {
+		return 0, errors.New("relay frame larger than read buffer")
+	}
+	return io.ReadFull(f.Conn, b[:n])
+}
+
+// relayFallback is tried once every direct candidate check has failed -
+// symmetric NAT on both ends means no punched hole will ever form, so the
+// only way through is to have an already-reachable provider relay for us.
+func (p *Pinger) relayFallback(serviceType services.ServiceType, brokerAddr, peerID, sessionID, sharedSecret string) error {
+	if p.relayDialer == nil {
+		return errors.New("no relay dialer configured")
+	}
+
+	relayConn, err := p.relayDialer.DialRelay(brokerAddr, peerID, sessionID, sharedSecret)
+	if err != nil {
+		return errors.Wrap(err, "relay fallback failed")
+	}
+
+	go p.natProxy.handOffRelay(serviceType, relayConn)
+	return nil
+}
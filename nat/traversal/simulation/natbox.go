@@ -0,0 +1,199 @@
+/*
+ * Copyright (C) 2019 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package simulation
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// NATType is the filtering behaviour a virtual NATBox enforces on inbound
+// datagrams, the four behaviours RFC 3489/STUN implementations distinguish.
+type NATType string
+
+const (
+	// FullCone lets any external host reply once we've sent out at least once.
+	FullCone NATType = "full-cone"
+	// RestrictedCone only admits replies from an IP we've previously sent to.
+	RestrictedCone NATType = "restricted-cone"
+	// PortRestrictedCone only admits replies from an IP:port we've previously sent to.
+	PortRestrictedCone NATType = "port-restricted-cone"
+	// Symmetric maps every distinct destination to its own external mapping,
+	// which is why a peer that only learned one mapping can't punch through.
+	Symmetric NATType = "symmetric"
+)
+
+// NATBox is a virtual router sitting in front of one simulated host. It
+// wraps a PacketConn-like pipe to the outside world, applying the chosen
+// NAT's filtering rules plus configurable per-hop delay, drop probability
+// and TTL decrement - so TTL-based hole punching can actually be exercised.
+type NATBox struct {
+	natType         NATType
+	hopDelay        time.Duration
+	dropProbability float64
+	ttlDecrement    int
+
+	publicAddr net.Addr
+	network    *SimNet
+
+	mu       sync.Mutex
+	sentTo   map[string]net.Addr // remote key -> remote addr, for cone filtering
+	mappings map[string]net.Addr // remote key -> our per-destination mapping (symmetric only)
+	bindings map[string]net.Addr // mapped addr key -> the one remote it was opened for (symmetric only)
+
+	// nextMappedPort is the next ephemeral port a symmetric box hands out.
+	// It's only ever touched under network.mu (see SimNet.allocateMapping),
+	// not mu, since handing out a fresh mapping also has to register it in
+	// the network's address table.
+	nextMappedPort int
+
+	inbox chan datagram
+}
+
+// newNATBox builds a NATBox of the given type in front of publicAddr,
+// registered with net so other boxes can route datagrams to it.
+func newNATBox(natType NATType, publicAddr net.Addr, network *SimNet, opts NATBoxOptions) *NATBox {
+	box := &NATBox{
+		natType:         natType,
+		hopDelay:        opts.HopDelay,
+		dropProbability: opts.DropProbability,
+		ttlDecrement:    opts.TTLDecrement,
+		publicAddr:      publicAddr,
+		network:         network,
+		sentTo:          make(map[string]net.Addr),
+		mappings:        make(map[string]net.Addr),
+		bindings:        make(map[string]net.Addr),
+		inbox:           make(chan datagram, 64),
+	}
+	if udp, ok := publicAddr.(*net.UDPAddr); ok {
+		box.nextMappedPort = udp.Port
+	}
+	return box
+}
+
+// NATBoxOptions configures the imperfections a NATBox simulates on top of
+// its filtering behaviour.
+type NATBoxOptions struct {
+	HopDelay        time.Duration
+	DropProbability float64
+	TTLDecrement    int
+}
+
+// send routes d from behind the box out to dst, recording the mapping the
+// box's NATType requires for an eventual reply to be let back in.
+func (b *NATBox) send(dst net.Addr, d datagram) {
+	b.mu.Lock()
+	b.sentTo[dst.String()] = dst
+	b.mu.Unlock()
+
+	d.from = b.sourceFor(dst)
+
+	d.ttl -= b.ttlDecrement
+	if d.ttl <= 0 {
+		return // TTL expired in transit, same as a real router silently dropping it
+	}
+
+	time.AfterFunc(b.hopDelay, func() {
+		if rand.Float64() < b.dropProbability {
+			return
+		}
+		b.network.deliver(dst, d)
+	})
+}
+
+// sourceFor returns the address the box's outbound packet to dst should
+// appear to come from. A symmetric NAT hands out a fresh external mapping
+// per destination - reusing the box's nominal publicAddr for every peer, the
+// way the other three NAT types do, is exactly the bug that made Symmetric
+// indistinguishable from PortRestrictedCone.
+func (b *NATBox) sourceFor(dst net.Addr) net.Addr {
+	if b.natType != Symmetric {
+		return b.publicAddr
+	}
+
+	b.mu.Lock()
+	mapped, ok := b.mappings[dst.String()]
+	b.mu.Unlock()
+	if ok {
+		return mapped
+	}
+
+	mapped = b.network.allocateMapping(b)
+
+	b.mu.Lock()
+	b.mappings[dst.String()] = mapped
+	b.bindings[mapped.String()] = dst
+	b.mu.Unlock()
+
+	return mapped
+}
+
+// receive is called by SimNet when a datagram addressed to localAddr (one of
+// this box's registered addresses) arrives from src; it's only handed to the
+// simulated host behind the box if the NATType's filtering rule admits it.
+func (b *NATBox) receive(localAddr, src net.Addr, d datagram) {
+	if !b.admits(localAddr, src) {
+		return
+	}
+
+	select {
+	case b.inbox <- d:
+	default:
+		// inbox full, drop - same as an overloaded router would
+	}
+}
+
+func (b *NATBox) admits(localAddr, src net.Addr) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.natType {
+	case FullCone:
+		return len(b.sentTo) > 0
+	case RestrictedCone:
+		for _, addr := range b.sentTo {
+			if host(addr) == host(src) {
+				return true
+			}
+		}
+		return false
+	case PortRestrictedCone:
+		_, ok := b.sentTo[src.String()]
+		return ok
+	case Symmetric:
+		// Unlike the cone types, admission isn't "have we ever sent to
+		// src" - it's "was the specific mapping the packet arrived on
+		// opened for src". A peer that only learned our address via a
+		// third party (e.g. a rendezvous server) is talking to a mapping
+		// that was never bound to it, and is correctly rejected even
+		// though we've sent to that peer elsewhere.
+		bound, ok := b.bindings[localAddr.String()]
+		return ok && bound.String() == src.String()
+	default:
+		return false
+	}
+}
+
+func host(addr net.Addr) string {
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		return udp.IP.String()
+	}
+	return addr.String()
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright (C) 2019 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package simulation
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// punch has a and b each send one datagram to the other's PublicAddr, the
+// way two peers that only rendezvoused through a third party would, and
+// reports whether each side actually received the other's packet.
+func punch(a, b *Host) (aReceived, bReceived bool) {
+	connA := a.dial(b.PublicAddr())
+	connB := b.dial(a.PublicAddr())
+
+	connA.Write([]byte("ping"))
+	connB.Write([]byte("ping"))
+
+	buf := make([]byte, 16)
+	aReceived = readWithin(connA, buf, 200*time.Millisecond)
+	bReceived = readWithin(connB, buf, 200*time.Millisecond)
+	return aReceived, bReceived
+}
+
+func readWithin(c net.Conn, buf []byte, timeout time.Duration) bool {
+	done := make(chan bool, 1)
+	go func() {
+		_, err := c.Read(buf)
+		done <- err == nil
+	}()
+
+	select {
+	case ok := <-done:
+		return ok
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func TestNATBoxCombinations(t *testing.T) {
+	tests := []struct {
+		name          string
+		natA, natB    NATType
+		wantAReceives bool
+		wantBReceives bool
+	}{
+		{"full-cone/full-cone", FullCone, FullCone, true, true},
+		{"full-cone/restricted-cone", FullCone, RestrictedCone, true, true},
+		{"restricted-cone/restricted-cone", RestrictedCone, RestrictedCone, true, true},
+		{"port-restricted/port-restricted", PortRestrictedCone, PortRestrictedCone, true, true},
+		{"full-cone/symmetric", FullCone, Symmetric, false, false},
+		{"port-restricted/symmetric", PortRestrictedCone, Symmetric, false, false},
+		{"symmetric/symmetric", Symmetric, Symmetric, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			net := NewSimNet()
+			a := net.AddHost(test.natA, NATBoxOptions{})
+			b := net.AddHost(test.natB, NATBoxOptions{})
+
+			aReceived, bReceived := punch(a, b)
+
+			if aReceived != test.wantAReceives {
+				t.Errorf("a received = %v, want %v", aReceived, test.wantAReceives)
+			}
+			if bReceived != test.wantBReceives {
+				t.Errorf("b received = %v, want %v", bReceived, test.wantBReceives)
+			}
+		})
+	}
+}
+
+// TestSymmetricSymmetricAlwaysFails pins down the deterministic failure case
+// the punch algorithm can never solve without a relay: two hosts both
+// behind symmetric NATs, each only knowing the other's PublicAddr (the
+// address a third-party rendezvous would have observed), can never punch
+// through directly - each side's NAT only ever opens a mapping bound to the
+// peer it's actually sending to, never to whatever a rendezvous server saw.
+func TestSymmetricSymmetricAlwaysFails(t *testing.T) {
+	for i := 0; i < 5; i++ {
+		net := NewSimNet()
+		a := net.AddHost(Symmetric, NATBoxOptions{})
+		b := net.AddHost(Symmetric, NATBoxOptions{})
+
+		aReceived, bReceived := punch(a, b)
+		if aReceived || bReceived {
+			t.Fatalf("round %d: expected symmetric-to-symmetric punch to fail deterministically, got aReceived=%v bReceived=%v", i, aReceived, bReceived)
+		}
+	}
+}
+
+// TestSymmetricMappedAddrForIsPerPeer confirms the bug the review flagged is
+// actually fixed: a symmetric box must hand out a distinct mapping for each
+// peer, and each must differ from the box's own nominal PublicAddr.
+func TestSymmetricMappedAddrForIsPerPeer(t *testing.T) {
+	net := NewSimNet()
+	a := net.AddHost(Symmetric, NATBoxOptions{})
+	peer1 := net.AddHost(FullCone, NATBoxOptions{})
+	peer2 := net.AddHost(FullCone, NATBoxOptions{})
+
+	mapped1 := a.MappedAddrFor(peer1.PublicAddr())
+	mapped2 := a.MappedAddrFor(peer2.PublicAddr())
+
+	if mapped1.String() == mapped2.String() {
+		t.Fatalf("expected distinct mappings per peer, got the same address %s for both", mapped1)
+	}
+	if mapped1.String() == a.PublicAddr().String() {
+		t.Fatalf("expected a per-peer mapping to differ from the box's nominal PublicAddr, both were %s", mapped1)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright (C) 2019 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package simulation provides an in-process harness for exercising NAT
+// traversal scenarios without real sockets or a physical network, modeled
+// on Ethereum's p2p/simulations/adapters inproc adapter.
+package simulation
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// datagram is one UDP packet travelling through a PipeConn, carrying the TTL
+// it was sent with so a NATBox hop can decrement it the way a real router would.
+type datagram struct {
+	payload []byte
+	ttl     int
+	from    net.Addr
+}
+
+// PipeConn is one end of an in-memory, TTL-aware UDP pipe - the simulation
+// equivalent of a *net.UDPConn, modeled on p2p/simulations/pipes.PipeConn.
+type PipeConn struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
+	in  chan datagram
+	out chan datagram
+
+	closed chan struct{}
+	ttl    int
+}
+
+// NewPipeConnPair returns two PipeConns, each other's peer: writes on one
+// arrive as reads on the other, as if joined by a real UDP socket pair.
+func NewPipeConnPair(localAddr, remoteAddr net.Addr) (*PipeConn, *PipeConn) {
+	ab := make(chan datagram, 64)
+	ba := make(chan datagram, 64)
+
+	a := &PipeConn{localAddr: localAddr, remoteAddr: remoteAddr, in: ba, out: ab, closed: make(chan struct{}), ttl: 64}
+	b := &PipeConn{localAddr: remoteAddr, remoteAddr: localAddr, in: ab, out: ba, closed: make(chan struct{}), ttl: 64}
+	return a, b
+}
+
+// Read implements net.Conn.
+func (c *PipeConn) Read(b []byte) (int, error) {
+	select {
+	case d, ok := <-c.in:
+		if !ok {
+			return 0, errors.New("pipe closed")
+		}
+		return copy(b, d.payload), nil
+	case <-c.closed:
+		return 0, errors.New("pipe closed")
+	}
+}
+
+// Write implements net.Conn. The datagram carries whatever TTL SetTTL last set.
+func (c *PipeConn) Write(b []byte) (int, error) {
+	payload := make([]byte, len(b))
+	copy(payload, b)
+
+	select {
+	case c.out <- datagram{payload: payload, ttl: c.ttl, from: c.localAddr}:
+		return len(b), nil
+	case <-c.closed:
+		return 0, errors.New("pipe closed")
+	}
+}
+
+// SetTTL sets the IP TTL every subsequent Write is tagged with, mirroring
+// ipv4.Conn.SetTTL so Pinger's TTL-punch trick can be exercised.
+func (c *PipeConn) SetTTL(ttl int) error {
+	c.ttl = ttl
+	return nil
+}
+
+// Close implements net.Conn.
+func (c *PipeConn) Close() error {
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return nil
+}
+
+// LocalAddr implements net.Conn.
+func (c *PipeConn) LocalAddr() net.Addr { return c.localAddr }
+
+// RemoteAddr implements net.Conn.
+func (c *PipeConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+// SetDeadline, SetReadDeadline and SetWriteDeadline are no-ops - the
+// simulation harness relies on drop probability and hop delay instead of
+// real timeouts, but the methods are kept so PipeConn satisfies net.Conn.
+func (c *PipeConn) SetDeadline(t time.Time) error      { return nil }
+func (c *PipeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *PipeConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,177 @@
+/*
+ * Copyright (C) 2019 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package simulation
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// SimNet is an in-process virtual network of NAT boxes, each fronting one
+// simulated host. It routes datagrams between boxes by public address and
+// applies each box's filtering rules, delay and drop probability - enough
+// to exercise NAT traversal logic without a real network or real sockets.
+type SimNet struct {
+	mu    sync.Mutex
+	boxes map[string]*NATBox
+	next  int
+}
+
+// NewSimNet creates an empty virtual network.
+func NewSimNet() *SimNet {
+	return &SimNet{boxes: make(map[string]*NATBox)}
+}
+
+// Host is one simulated peer sitting behind a NATBox.
+type Host struct {
+	box *NATBox
+}
+
+// AddHost creates a new simulated host behind a NATBox of the given type,
+// assigning it a unique public address on the virtual network.
+func (n *SimNet) AddHost(natType NATType, opts NATBoxOptions) *Host {
+	n.mu.Lock()
+	n.next++
+	publicAddr := &net.UDPAddr{IP: net.IPv4(203, 0, 113, byte(n.next)), Port: 50000 + n.next}
+	n.mu.Unlock()
+
+	box := newNATBox(natType, publicAddr, n, opts)
+
+	n.mu.Lock()
+	n.boxes[publicAddr.String()] = box
+	n.mu.Unlock()
+
+	return &Host{box: box}
+}
+
+// PublicAddr is the address other hosts on the network reach this host
+// through - analogous to a real peer's router-assigned public IP:port.
+//
+// For a host behind a symmetric NAT, this is only ever the nominal address a
+// third party (e.g. a STUN server) would observe; it's never itself a valid
+// mapping for a direct peer, so traversal code that relies solely on
+// PublicAddr to punch through a symmetric NAT must fail. See MappedAddrFor.
+func (h *Host) PublicAddr() net.Addr {
+	return h.box.publicAddr
+}
+
+// MappedAddrFor is the address h's NAT box uses when it sends to peer
+// specifically. Behind full-cone, restricted-cone and port-restricted-cone
+// boxes this is the same as PublicAddr - those NAT types reuse one external
+// mapping for every peer. Behind a symmetric box it's a distinct, lazily
+// allocated mapping per peer, the real-world reason two hosts both behind
+// symmetric NATs can't punch through using addresses learned via a
+// rendezvous server: neither one's mapping for the other was ever opened.
+func (h *Host) MappedAddrFor(peer net.Addr) net.Addr {
+	return h.box.sourceFor(peer)
+}
+
+// DialFunc returns a dial function matching traversal's dialFunc signature,
+// so a Pinger can be built with NewSimulatedPingerFactory to punch through
+// this host's virtual NAT box instead of a real socket.
+func (h *Host) DialFunc() func(ip string, port int, pingerPort int) (net.Conn, error) {
+	return func(ip string, port int, _ int) (net.Conn, error) {
+		remote := &net.UDPAddr{IP: net.ParseIP(ip), Port: port}
+		if remote.IP == nil {
+			return nil, fmt.Errorf("simulation: invalid remote IP %q", ip)
+		}
+		return h.dial(remote), nil
+	}
+}
+
+func (h *Host) dial(remote net.Addr) net.Conn {
+	return &hostConn{host: h, remote: remote, ttl: 64}
+}
+
+// deliver routes a datagram sent toward dst to the box registered for it,
+// if any - an unreachable dst is simply dropped, like a real router would.
+func (n *SimNet) deliver(dst net.Addr, d datagram) {
+	n.mu.Lock()
+	box, ok := n.boxes[dst.String()]
+	n.mu.Unlock()
+	if !ok {
+		return
+	}
+	box.receive(dst, d.from, d)
+}
+
+// allocateMapping hands box a fresh external address on its own public IP
+// and registers it so inbound datagrams addressed to it route back to box -
+// used by symmetric NATBoxes, which need one such mapping per destination
+// rather than the single shared publicAddr every other NATType reuses.
+func (n *SimNet) allocateMapping(box *NATBox) net.Addr {
+	base, ok := box.publicAddr.(*net.UDPAddr)
+	if !ok {
+		return box.publicAddr
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	box.nextMappedPort++
+	mapped := &net.UDPAddr{IP: base.IP, Port: box.nextMappedPort}
+	n.boxes[mapped.String()] = box
+	return mapped
+}
+
+// hostConn is the net.Conn a Pinger dials: one host's view of a single
+// logical connection to one remote public address, mirroring the behaviour
+// of a connected *net.UDPConn (reads are filtered to the connected peer).
+type hostConn struct {
+	host   *Host
+	remote net.Addr
+	ttl    int
+}
+
+func (c *hostConn) Read(b []byte) (int, error) {
+	for {
+		d, ok := <-c.host.box.inbox
+		if !ok {
+			return 0, errors.New("simulation: host closed")
+		}
+		if d.from.String() != c.remote.String() {
+			continue // not from our connected peer - a real connected UDP socket would drop it too
+		}
+		return copy(b, d.payload), nil
+	}
+}
+
+func (c *hostConn) Write(b []byte) (int, error) {
+	payload := make([]byte, len(b))
+	copy(payload, b)
+	// from is set by box.send itself (it depends on the NAT type and dst).
+	c.host.box.send(c.remote, datagram{payload: payload, ttl: c.ttl})
+	return len(b), nil
+}
+
+// SetTTL lets traversal.Pinger's TTL-based hole punching drive this
+// connection the same way it would drive a real socket via ipv4.Conn.
+func (c *hostConn) SetTTL(ttl int) error {
+	c.ttl = ttl
+	return nil
+}
+
+func (c *hostConn) Close() error                       { return nil }
+func (c *hostConn) LocalAddr() net.Addr                { return c.host.box.publicAddr }
+func (c *hostConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *hostConn) SetDeadline(t time.Time) error      { return nil }
+func (c *hostConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *hostConn) SetWriteDeadline(t time.Time) error { return nil }
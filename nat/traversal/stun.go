@@ -0,0 +1,140 @@
+/*
+ * Copyright (C) 2019 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package traversal
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A minimal RFC 5389 STUN client - just enough to send a Binding Request and
+// decode the XOR-MAPPED-ADDRESS attribute from the response. We don't need
+// anything else of the protocol (no TURN, no authentication) to learn our
+// server-reflexive address.
+
+const stunMagicCookie = 0x2112A442
+const stunBindingRequestType = 0x0001
+const stunBindingSuccess = 0x0101
+const stunAttrXorMappedAddress = 0x0020
+const stunTimeout = 2 * time.Second
+
+// stunBindingRequest sends a Binding Request to the given STUN server from a
+// socket bound to localPort and returns the reflexive address it reports.
+func stunBindingRequest(server string, localPort int) (net.IP, int, error) {
+	serverAddr, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to resolve STUN server")
+	}
+
+	conn, err := net.DialUDP("udp4", &net.UDPAddr{Port: localPort}, serverAddr)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to dial STUN server")
+	}
+	defer conn.Close()
+
+	var transactionID [12]byte
+	if _, err := rand.Read(transactionID[:]); err != nil {
+		return nil, 0, errors.Wrap(err, "failed to generate STUN transaction id")
+	}
+
+	request := make([]byte, 20)
+	binary.BigEndian.PutUint16(request[0:2], stunBindingRequestType)
+	binary.BigEndian.PutUint16(request[2:4], 0)
+	binary.BigEndian.PutUint32(request[4:8], stunMagicCookie)
+	copy(request[8:20], transactionID[:])
+
+	if err := conn.SetDeadline(time.Now().Add(stunTimeout)); err != nil {
+		return nil, 0, err
+	}
+	if _, err := conn.Write(request); err != nil {
+		return nil, 0, errors.Wrap(err, "failed to send STUN request")
+	}
+
+	response := make([]byte, 512)
+	n, err := conn.Read(response)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to read STUN response")
+	}
+
+	return parseStunBindingResponse(response[:n], transactionID)
+}
+
+func parseStunBindingResponse(data []byte, wantTransactionID [12]byte) (net.IP, int, error) {
+	if len(data) < 20 {
+		return nil, 0, errors.New("STUN response too short")
+	}
+	msgType := binary.BigEndian.Uint16(data[0:2])
+	msgLen := binary.BigEndian.Uint16(data[2:4])
+	if msgType != stunBindingSuccess {
+		return nil, 0, errors.New("unexpected STUN message type")
+	}
+	var transactionID [12]byte
+	copy(transactionID[:], data[8:20])
+	if transactionID != wantTransactionID {
+		return nil, 0, errors.New("STUN transaction id mismatch")
+	}
+
+	attrs := data[20:]
+	if int(msgLen) > len(attrs) {
+		return nil, 0, errors.New("STUN message length exceeds packet")
+	}
+	attrs = attrs[:msgLen]
+
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := binary.BigEndian.Uint16(attrs[2:4])
+		value := attrs[4:]
+		if int(attrLen) > len(value) {
+			return nil, 0, errors.New("STUN attribute length exceeds packet")
+		}
+		value = value[:attrLen]
+
+		if attrType == stunAttrXorMappedAddress {
+			return parseXorMappedAddress(value)
+		}
+
+		// attributes are padded to a multiple of 4 bytes
+		padded := (int(attrLen) + 3) &^ 3
+		attrs = attrs[4+padded:]
+	}
+
+	return nil, 0, errors.New("STUN response missing XOR-MAPPED-ADDRESS")
+}
+
+func parseXorMappedAddress(value []byte) (net.IP, int, error) {
+	if len(value) < 8 || value[1] != 0x01 {
+		return nil, 0, errors.New("only IPv4 XOR-MAPPED-ADDRESS is supported")
+	}
+
+	xport := binary.BigEndian.Uint16(value[2:4])
+	port := int(xport ^ uint16(stunMagicCookie>>16))
+
+	var cookie [4]byte
+	binary.BigEndian.PutUint32(cookie[:], stunMagicCookie)
+
+	ip := make(net.IP, 4)
+	for i := 0; i < 4; i++ {
+		ip[i] = value[4+i] ^ cookie[i]
+	}
+
+	return ip, port, nil
+}
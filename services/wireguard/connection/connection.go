@@ -23,6 +23,7 @@ import (
 	log "github.com/cihub/seelog"
 	"github.com/mysteriumnetwork/node/core/connection"
 	wg "github.com/mysteriumnetwork/node/services/wireguard"
+	"github.com/mysteriumnetwork/node/services/wireguard/connection/netmon"
 	endpoint "github.com/mysteriumnetwork/node/services/wireguard/endpoint"
 )
 
@@ -36,6 +37,35 @@ type Connection struct {
 	config             wg.ServiceConfig
 	consumerKey        wg.ConsumerPrivateKey
 	connectionEndpoint wg.ConnectionEndpoint
+
+	netMon            *netmon.Monitor
+	netMonUnsubscribe func()
+
+	mtuProber *MTUProber
+	mtuMu     sync.Mutex
+	pinnedMTU int
+}
+
+// Statistics exposes runtime facts about the active connection that aren't
+// part of the connection.Connection interface but are useful for diagnostics.
+type Statistics struct {
+	// PinnedMTU is the tunnel MTU applied by the most recent pinMTU attempt,
+	// or 0 if that attempt applied none (path MTU discovery or SetMTU failed,
+	// or the connection endpoint doesn't support MTU pinning).
+	PinnedMTU int
+}
+
+// Statistics returns a snapshot of the connection's current diagnostics.
+func (c *Connection) Statistics() Statistics {
+	c.mtuMu.Lock()
+	defer c.mtuMu.Unlock()
+	return Statistics{PinnedMTU: c.pinnedMTU}
+}
+
+func (c *Connection) setPinnedMTU(mtu int) {
+	c.mtuMu.Lock()
+	c.pinnedMTU = mtu
+	c.mtuMu.Unlock()
 }
 
 // Start establish wireguard connection to the service provider.
@@ -60,9 +90,60 @@ func (c *Connection) Start() (err error) {
 		return err
 	}
 	c.stateChannel <- connection.Connected
+
+	c.mtuProber = NewMTUProber()
+	c.setPinnedMTU(pinMTU(c.mtuProber, c.connectionEndpoint, &c.config.Provider.Endpoint))
+
+	c.netMon = netmon.NewMonitor()
+	if err := c.netMon.Start(); err != nil {
+		log.Warn(logPrefix, "Failed to start network change monitor, tunnel won't survive a route change: ", err)
+		return nil
+	}
+	c.netMonUnsubscribe = c.netMon.Subscribe(c.onNetworkChange)
+
 	return nil
 }
 
+// onNetworkChange re-establishes the wireguard endpoint against a fresh
+// local port whenever the default route or primary interface changes
+// (network switch, Wi-Fi reassociation, VPN interface flap). The
+// caller-visible StateChannel reports Reconnecting for the duration of the
+// restart rather than going silent, and NotConnected if the restart itself
+// fails, so a caller watching StateChannel never sees a stale Connected for
+// a tunnel that's actually down.
+func (c *Connection) onNetworkChange(_ netmon.ChangeEvent) {
+	log.Info(logPrefix, "Network change detected, restarting wireguard endpoint")
+	c.stateChannel <- connection.Reconnecting
+
+	if err := c.connectionEndpoint.Stop(); err != nil {
+		log.Warn(logPrefix, "Failed to stop connection endpoint during restart: ", err)
+	}
+
+	freshEndpoint, err := endpoint.NewConnectionEndpoint(nil)
+	if err != nil {
+		log.Error(logPrefix, "Failed to recreate connection endpoint after network change: ", err)
+		c.stateChannel <- connection.NotConnected
+		return
+	}
+	c.connectionEndpoint = freshEndpoint
+
+	if err := c.connectionEndpoint.Start(&c.config); err != nil {
+		log.Error(logPrefix, "Failed to restart connection endpoint after network change: ", err)
+		c.stateChannel <- connection.NotConnected
+		return
+	}
+
+	if err := c.connectionEndpoint.AddPeer(c.config.Provider.PublicKey, &c.config.Provider.Endpoint); err != nil {
+		log.Error(logPrefix, "Failed to re-add peer after network change: ", err)
+		c.stateChannel <- connection.NotConnected
+		return
+	}
+
+	c.mtuProber.Forget(&c.config.Provider.Endpoint)
+	c.setPinnedMTU(pinMTU(c.mtuProber, c.connectionEndpoint, &c.config.Provider.Endpoint))
+	c.stateChannel <- connection.Connected
+}
+
 // Wait blocks until wireguard connection not stopped.
 func (c *Connection) Wait() error {
 	c.connection.Wait()
@@ -73,6 +154,13 @@ func (c *Connection) Wait() error {
 func (c *Connection) Stop() {
 	c.stateChannel <- connection.Disconnecting
 
+	if c.netMonUnsubscribe != nil {
+		c.netMonUnsubscribe()
+	}
+	if c.netMon != nil {
+		c.netMon.Stop()
+	}
+
 	if err := c.connectionEndpoint.Stop(); err != nil {
 		log.Error(logPrefix, "Failed to close wireguard connection", err)
 	}
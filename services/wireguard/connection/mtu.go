@@ -0,0 +1,159 @@
+/*
+ * Copyright (C) 2020 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package connection
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+)
+
+// minProbedMTU/maxProbedMTU bound the binary search: 1280 is the IPv6
+// minimum (and low enough to work almost everywhere), 1500 is Ethernet's.
+const minProbedMTU = 1280
+const maxProbedMTU = 1500
+
+// wireguardOverhead is the worst-case per-packet overhead WireGuard adds
+// (IP + UDP + WG data header), subtracted from the probed path MTU before
+// it's applied to the tunnel interface.
+const wireguardOverhead = 80
+
+// ipv4UDPHeaderSize is the IPv4 plus UDP header every probe datagram carries
+// on top of its payload, so a payload of size-ipv4UDPHeaderSize bytes makes
+// an IP packet of exactly size bytes.
+const ipv4UDPHeaderSize = 20 + 8
+
+const probeTimeout = 500 * time.Millisecond
+const probeAttempts = 3
+
+// mtuCacheTTL bounds how long a discovered path MTU is trusted before
+// Probe re-runs the full binary search for a given endpoint, even absent an
+// explicit Forget.
+const mtuCacheTTL = 10 * time.Minute
+
+// mtuSetter is implemented by connection endpoints that can reconfigure the
+// wireguard interface's MTU after it's already up.
+type mtuSetter interface {
+	SetMTU(mtu int) error
+}
+
+// MTUProber discovers the path MTU to endpoint - the largest IP packet that
+// reaches it without fragmentation - via DF-bit probes and a binary search, the same idea as
+// classic path-MTU discovery. Results are cached per provider endpoint, so
+// a reconnect that isn't a genuine path change doesn't re-run the whole
+// search every time.
+type MTUProber struct {
+	mu    sync.Mutex
+	cache map[string]mtuCacheEntry
+}
+
+type mtuCacheEntry struct {
+	mtu        int
+	discovered time.Time
+}
+
+// NewMTUProber returns an MTUProber with an empty cache.
+func NewMTUProber() *MTUProber {
+	return &MTUProber{cache: make(map[string]mtuCacheEntry)}
+}
+
+// Probe binary-searches [minProbedMTU, maxProbedMTU] for the largest packet
+// size that reaches endpoint intact, and returns the resulting path MTU. A
+// cached result younger than mtuCacheTTL is returned without re-probing.
+func (p *MTUProber) Probe(endpoint *net.UDPAddr) (int, error) {
+	key := endpoint.String()
+
+	p.mu.Lock()
+	if entry, ok := p.cache[key]; ok && time.Since(entry.discovered) < mtuCacheTTL {
+		p.mu.Unlock()
+		return entry.mtu, nil
+	}
+	p.mu.Unlock()
+
+	conn, err := net.DialUDP("udp", nil, endpoint)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to open MTU probe socket")
+	}
+	defer conn.Close()
+
+	packetConn := ipv4.NewConn(conn)
+	if err := packetConn.SetDontFragment(true); err != nil {
+		return 0, errors.Wrap(err, "failed to set the DF bit for MTU probing")
+	}
+
+	lo, hi := minProbedMTU, maxProbedMTU
+	best := minProbedMTU
+
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		if probeSize(conn, mid-ipv4UDPHeaderSize) {
+			best = mid
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
+	}
+
+	log.Info(logPrefix, "discovered path MTU of ", best, " bytes to ", endpoint)
+
+	p.mu.Lock()
+	p.cache[key] = mtuCacheEntry{mtu: best, discovered: time.Now()}
+	p.mu.Unlock()
+
+	return best, nil
+}
+
+// Forget drops any cached path MTU for endpoint, so the next Probe re-runs
+// full discovery instead of serving a result that may no longer hold -
+// namely after a netmon interface-change event, where the path to endpoint
+// may have changed entirely.
+func (p *MTUProber) Forget(endpoint *net.UDPAddr) {
+	p.mu.Lock()
+	delete(p.cache, endpoint.String())
+	p.mu.Unlock()
+}
+
+// pinMTU probes the path to endpoint via prober and, if connectionEndpoint
+// knows how to apply it, pins the tunnel interface's MTU to the discovered
+// path MTU minus WireGuard's own overhead. It returns the pinned MTU, or 0
+// if none was applied.
+func pinMTU(prober *MTUProber, connectionEndpoint interface{}, endpoint *net.UDPAddr) int {
+	setter, ok := connectionEndpoint.(mtuSetter)
+	if !ok {
+		log.Debug(logPrefix, "connection endpoint doesn't support MTU pinning, leaving the default MTU in place")
+		return 0
+	}
+
+	pathMTU, err := prober.Probe(endpoint)
+	if err != nil {
+		log.Warn(logPrefix, "path MTU discovery failed, leaving the default MTU in place: ", err)
+		return 0
+	}
+
+	tunnelMTU := pathMTU - wireguardOverhead
+	if err := setter.SetMTU(tunnelMTU); err != nil {
+		log.Warn(logPrefix, "failed to pin wireguard interface MTU to ", tunnelMTU, ": ", err)
+		return 0
+	}
+
+	return tunnelMTU
+}
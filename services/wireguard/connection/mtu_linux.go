@@ -0,0 +1,127 @@
+/*
+ * Copyright (C) 2020 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package connection
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// fragWaitTimeout bounds how long probeSize waits for the asynchronous ICMP
+// "fragmentation needed" to come back on the error queue after a write. The
+// ICMP isn't generated by our own kernel - it has to be emitted by whichever
+// router on the path rejected the oversized datagram and travel back to us,
+// so checking the error queue once, immediately after Write, almost always
+// finds nothing and wrongly reports success.
+const fragWaitTimeout = 150 * time.Millisecond
+
+// fragPollInterval is how often we re-check the error queue while waiting.
+const fragPollInterval = 10 * time.Millisecond
+
+// probeSize sends a single DF-set UDP datagram of size bytes and reports
+// whether the path actually carried it. A successful Write only proves the
+// kernel accepted the packet for sending, not that it arrived - a router
+// dropping an over-MTU, DF-set datagram replies with an asynchronous ICMP
+// "fragmentation needed" that Write can't observe. IP_RECVERR plus
+// MSG_ERRQUEUE is how Linux surfaces that ICMP back to us, so we poll the
+// socket's error queue for it for a short while after every write.
+func probeSize(conn *net.UDPConn, size int) bool {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var setErr error
+	if ctrlErr := rawConn.Control(func(fd uintptr) {
+		setErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVERR, 1)
+	}); ctrlErr != nil || setErr != nil {
+		return false
+	}
+
+	payload := make([]byte, size)
+	for attempt := 0; attempt < probeAttempts; attempt++ {
+		if err := conn.SetDeadline(time.Now().Add(probeTimeout)); err != nil {
+			return false
+		}
+		if _, err := conn.Write(payload); err != nil {
+			continue
+		}
+		if fragNeeded(rawConn) {
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// fragNeeded polls the socket's error queue for up to fragWaitTimeout,
+// looking for the EMSGSIZE entry a DF-set datagram that needed
+// fragmentation leaves behind - the ICMP that produces it is asynchronous,
+// so a single immediate check would almost always miss it.
+func fragNeeded(rawConn syscall.RawConn) bool {
+	deadline := time.Now().Add(fragWaitTimeout)
+	for {
+		if errQueueHasFragNeeded(rawConn) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(fragPollInterval)
+	}
+}
+
+func errQueueHasFragNeeded(rawConn syscall.RawConn) bool {
+	oob := make([]byte, 512)
+	var found bool
+	_ = rawConn.Read(func(fd uintptr) bool {
+		_, oobn, _, _, err := unix.Recvmsg(int(fd), nil, oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+		if err != nil {
+			return true
+		}
+		found = parseExtendedErr(oob[:oobn])
+		return true
+	})
+	return found
+}
+
+// parseExtendedErr looks for a SOL_IP/IP_RECVERR control message carrying a
+// sock_extended_err whose ee_errno is EMSGSIZE, per linux/errqueue.h.
+func parseExtendedErr(oob []byte) bool {
+	cmsgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return false
+	}
+	for _, cmsg := range cmsgs {
+		if cmsg.Header.Level != unix.SOL_IP || cmsg.Header.Type != unix.IP_RECVERR {
+			continue
+		}
+		if len(cmsg.Data) < 4 {
+			continue
+		}
+		errno := binary.LittleEndian.Uint32(cmsg.Data[0:4])
+		if errno == uint32(unix.EMSGSIZE) {
+			return true
+		}
+	}
+	return false
+}
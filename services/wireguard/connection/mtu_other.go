@@ -0,0 +1,47 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * Copyright (C) 2020 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package connection
+
+import (
+	"net"
+	"time"
+)
+
+// probeSize sends a single DF-set UDP datagram of size bytes and reports
+// whether the write succeeded. Outside Linux we have no portable way to read
+// back the asynchronous ICMP "fragmentation needed" a dropped DF-set
+// datagram produces (that needs IP_RECVERR/MSG_ERRQUEUE, which is
+// Linux-only), so a successful Write is the best signal available here -
+// the binary search will tend to over-estimate the true path MTU on these
+// platforms.
+func probeSize(conn *net.UDPConn, size int) bool {
+	payload := make([]byte, size)
+	for attempt := 0; attempt < probeAttempts; attempt++ {
+		if err := conn.SetDeadline(time.Now().Add(probeTimeout)); err != nil {
+			return false
+		}
+		if _, err := conn.Write(payload); err != nil {
+			continue
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (C) 2020 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package netmon watches the host's routing table and network interfaces for
+// changes that would invalidate an existing tunnel - a new default route, a
+// different primary interface, a Wi-Fi to cellular handover - and notifies
+// subscribers so they can re-establish affected connections. Ported from the
+// idea behind Tailscale's wgengine/monitor.
+package netmon
+
+import (
+	"sync"
+
+	log "github.com/cihub/seelog"
+)
+
+const logPrefix = "[netmon] "
+
+// ChangeEvent describes what kind of network change triggered a callback.
+type ChangeEvent struct {
+	// DefaultRouteChanged is true when a routing change was observed. The
+	// netlink, route socket and IP Helper sources set it for any route added
+	// or removed, not only for a change of the default route; the polling
+	// source sets it when the default route's interface changed.
+	DefaultRouteChanged bool
+	// InterfaceChanged is true when the primary interface was added,
+	// removed, or changed state (e.g. Wi-Fi association).
+	InterfaceChanged bool
+}
+
+// Callback is invoked whenever the monitor observes a relevant change.
+type Callback func(ChangeEvent)
+
+// Monitor watches OS-level network state and fires Callback on every change
+// that could mean an existing tunnel no longer has a working path out.
+type Monitor struct {
+	mu        sync.Mutex
+	callbacks map[int]Callback
+	nextID    int
+
+	source monitorSource
+	stop   chan struct{}
+}
+
+// monitorSource is implemented per-OS (netlink on Linux, a route socket on
+// Darwin/BSD, the IP Helper API on Windows).
+type monitorSource interface {
+	// Subscribe starts watching and sends a ChangeEvent to events on every
+	// relevant change until stop is closed.
+	Subscribe(events chan<- ChangeEvent, stop <-chan struct{}) error
+}
+
+// NewMonitor creates a Monitor using the platform's native change source.
+func NewMonitor() *Monitor {
+	return &Monitor{
+		callbacks: make(map[int]Callback),
+		source:    newPlatformSource(),
+	}
+}
+
+// Subscribe registers cb to run on every observed network change and returns
+// an unsubscribe func.
+func (m *Monitor) Subscribe(cb Callback) (unsubscribe func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := m.nextID
+	m.nextID++
+	m.callbacks[id] = cb
+
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.callbacks, id)
+	}
+}
+
+// Start begins watching for network changes in the background.
+func (m *Monitor) Start() error {
+	m.mu.Lock()
+	if m.stop != nil {
+		m.mu.Unlock()
+		return nil
+	}
+	m.stop = make(chan struct{})
+	stop := m.stop
+	m.mu.Unlock()
+
+	events := make(chan ChangeEvent, 8)
+	if err := m.source.Subscribe(events, stop); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case ev := <-events:
+				log.Debug(logPrefix, "network change observed: ", ev)
+				m.notify(ev)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops watching for network changes.
+func (m *Monitor) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stop == nil {
+		return
+	}
+	close(m.stop)
+	m.stop = nil
+}
+
+func (m *Monitor) notify(ev ChangeEvent) {
+	m.mu.Lock()
+	callbacks := make([]Callback, 0, len(m.callbacks))
+	for _, cb := range m.callbacks {
+		callbacks = append(callbacks, cb)
+	}
+	m.mu.Unlock()
+
+	for _, cb := range callbacks {
+		cb(ev)
+	}
+}
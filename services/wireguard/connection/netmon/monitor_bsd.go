@@ -0,0 +1,105 @@
+//go:build darwin || freebsd || dragonfly || netbsd || openbsd
+// +build darwin freebsd dragonfly netbsd openbsd
+
+/*
+ * Copyright (C) 2020 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package netmon
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/route"
+)
+
+// routeReadTimeout bounds how long a single Read blocks, so the reader
+// goroutine periodically wakes up to re-check stop even when no route
+// event arrives - without it, Stop() closing stop doesn't unblock an
+// in-flight read, and the goroutine (and its fd) leaks until the next
+// route/link event happens to arrive.
+const routeReadTimeout = 1 * time.Second
+
+// routeSocketSource watches a PF_ROUTE socket for RTM_NEWADDR/RTM_DELADDR
+// and RTM_IFINFO messages, which is how macOS/BSD notify userspace of
+// routing table and interface changes.
+type routeSocketSource struct{}
+
+func newPlatformSource() monitorSource {
+	return &routeSocketSource{}
+}
+
+func (s *routeSocketSource) Subscribe(events chan<- ChangeEvent, stop <-chan struct{}) error {
+	fd, err := syscall.Socket(syscall.AF_ROUTE, syscall.SOCK_RAW, syscall.AF_UNSPEC)
+	if err != nil {
+		return errors.Wrap(err, "failed to open route socket")
+	}
+
+	timeout := syscall.NsecToTimeval(routeReadTimeout.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+		syscall.Close(fd)
+		return errors.Wrap(err, "failed to set route socket read timeout")
+	}
+
+	go func() {
+		defer syscall.Close(fd)
+
+		buf := make([]byte, 4096)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			n, err := syscall.Read(fd, buf)
+			if err != nil {
+				continue
+			}
+
+			msgs, err := route.ParseRIB(route.RIBTypeRoute, buf[:n])
+			if err != nil {
+				continue
+			}
+
+			ev := classifyRouteMessages(msgs)
+			if ev.DefaultRouteChanged || ev.InterfaceChanged {
+				select {
+				case events <- ev:
+				case <-stop:
+					return
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func classifyRouteMessages(msgs []route.Message) ChangeEvent {
+	var ev ChangeEvent
+	for _, msg := range msgs {
+		switch msg.(type) {
+		case *route.RouteMessage:
+			ev.DefaultRouteChanged = true
+		case *route.InterfaceMessage, *route.InterfaceAddrMessage:
+			ev.InterfaceChanged = true
+		}
+	}
+	return ev
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (C) 2020 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package netmon
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// netlinkReadTimeout bounds how long a single Recvfrom blocks, so the
+// reader goroutine periodically wakes up to re-check stop even when no
+// netlink event arrives - without it, Stop() closing stop doesn't unblock
+// an in-flight read, and the goroutine (and its fd) leaks until the next
+// route/link event happens to arrive.
+const netlinkReadTimeout = 1 * time.Second
+
+// netlinkSource watches RTMGRP_IPV4_ROUTE/RTMGRP_LINK notifications on a
+// NETLINK_ROUTE socket, the same mechanism ip-monitor(8) uses.
+type netlinkSource struct{}
+
+func newPlatformSource() monitorSource {
+	return &netlinkSource{}
+}
+
+func (s *netlinkSource) Subscribe(events chan<- ChangeEvent, stop <-chan struct{}) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW, unix.NETLINK_ROUTE)
+	if err != nil {
+		return errors.Wrap(err, "failed to open netlink socket")
+	}
+
+	addr := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_IPV4_ROUTE | unix.RTMGRP_IPV6_ROUTE | unix.RTMGRP_LINK,
+	}
+	if err := unix.Bind(fd, addr); err != nil {
+		unix.Close(fd)
+		return errors.Wrap(err, "failed to bind netlink socket")
+	}
+
+	timeout := unix.NsecToTimeval(netlinkReadTimeout.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		unix.Close(fd)
+		return errors.Wrap(err, "failed to set netlink read timeout")
+	}
+
+	go func() {
+		defer unix.Close(fd)
+
+		buf := make([]byte, 4096)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			n, _, err := unix.Recvfrom(fd, buf, 0)
+			if err != nil {
+				continue
+			}
+
+			msgs, err := unix.ParseNetlinkMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+
+			ev := classifyMessages(msgs)
+			if ev.DefaultRouteChanged || ev.InterfaceChanged {
+				select {
+				case events <- ev:
+				case <-stop:
+					return
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func classifyMessages(msgs []unix.NetlinkMessage) ChangeEvent {
+	var ev ChangeEvent
+	for _, msg := range msgs {
+		switch msg.Header.Type {
+		case unix.RTM_NEWROUTE, unix.RTM_DELROUTE:
+			ev.DefaultRouteChanged = true
+		case unix.RTM_NEWLINK, unix.RTM_DELLINK, unix.RTM_NEWADDR, unix.RTM_DELADDR:
+			ev.InterfaceChanged = true
+		}
+	}
+	return ev
+}
@@ -0,0 +1,95 @@
+//go:build !linux && !windows && !darwin && !freebsd && !dragonfly && !netbsd && !openbsd
+// +build !linux,!windows,!darwin,!freebsd,!dragonfly,!netbsd,!openbsd
+
+/*
+ * Copyright (C) 2020 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package netmon
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// pollingSource is the fallback for platforms without a native change
+// notification mechanism wired up: it periodically snapshots the default
+// route's interface and diffs it against the previous snapshot.
+type pollingSource struct{}
+
+const pollInterval = 5 * time.Second
+
+func newPlatformSource() monitorSource {
+	return &pollingSource{}
+}
+
+func (s *pollingSource) Subscribe(events chan<- ChangeEvent, stop <-chan struct{}) error {
+	go func() {
+		last := defaultRouteInterface()
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				current := defaultRouteInterface()
+				if current != last {
+					last = current
+					select {
+					case events <- ChangeEvent{DefaultRouteChanged: true}:
+					case <-stop:
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// defaultRouteInterface approximates "what interface carries our default
+// route" by asking the OS which local address it would use to reach the
+// public internet, then matching it against interface addresses.
+func defaultRouteInterface() string {
+	conn, err := net.Dial("udp", "8.8.8.8:80")
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+
+	localIP := conn.LocalAddr().(*net.UDPAddr).IP.String()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if strings.HasPrefix(addr.String(), localIP+"/") {
+				return iface.Name
+			}
+		}
+	}
+	return ""
+}
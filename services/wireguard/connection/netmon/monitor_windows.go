@@ -0,0 +1,99 @@
+/*
+ * Copyright (C) 2020 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package netmon
+
+import (
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// ipHelperSource registers NotifyRouteChange2/NotifyIpInterfaceChange
+// callbacks with iphlpapi.dll - the Windows IP Helper API's native way of
+// telling userspace the routing table or an interface just changed.
+type ipHelperSource struct{}
+
+func newPlatformSource() monitorSource {
+	return &ipHelperSource{}
+}
+
+var (
+	modIPHlpAPI                 = syscall.NewLazyDLL("iphlpapi.dll")
+	procNotifyRouteChange2      = modIPHlpAPI.NewProc("NotifyRouteChange2")
+	procNotifyIPInterfaceChange = modIPHlpAPI.NewProc("NotifyIpInterfaceChange")
+	procCancelMibChangeNotify2  = modIPHlpAPI.NewProc("CancelMibChangeNotify2")
+)
+
+const afUnspec = 0
+
+var callbackMu sync.Mutex
+
+func (s *ipHelperSource) Subscribe(events chan<- ChangeEvent, stop <-chan struct{}) error {
+	routeHandle, err := registerNotification(procNotifyRouteChange2, afUnspec, func() {
+		sendEvent(events, stop, ChangeEvent{DefaultRouteChanged: true})
+	})
+	if err != nil {
+		return errors.Wrap(err, "NotifyRouteChange2 failed")
+	}
+
+	ifaceHandle, err := registerNotification(procNotifyIPInterfaceChange, afUnspec, func() {
+		sendEvent(events, stop, ChangeEvent{InterfaceChanged: true})
+	})
+	if err != nil {
+		procCancelMibChangeNotify2.Call(routeHandle)
+		return errors.Wrap(err, "NotifyIpInterfaceChange failed")
+	}
+
+	go func() {
+		<-stop
+		procCancelMibChangeNotify2.Call(routeHandle)
+		procCancelMibChangeNotify2.Call(ifaceHandle)
+	}()
+
+	return nil
+}
+
+// registerNotification wraps the IP Helper *Notify*Change2 family, which all
+// share the signature: (AddressFamily, Callback, CallerContext, InitialNotification, *HANDLE).
+func registerNotification(proc *syscall.LazyProc, family uintptr, onChange func()) (uintptr, error) {
+	// Serializes registration only; Windows later invokes the callback
+	// created below on its own notification thread without holding callbackMu.
+	callbackMu.Lock()
+	defer callbackMu.Unlock()
+
+	callback := syscall.NewCallback(func(_ uintptr, _ uintptr, _ uintptr) uintptr {
+		onChange()
+		return 0
+	})
+
+	var handle uintptr
+	ret, _, _ := proc.Call(family, callback, 0, 0, uintptr(unsafe.Pointer(&handle)))
+	if ret != 0 {
+		return 0, errors.Errorf("%s returned error code %d", proc.Name, ret)
+	}
+	return handle, nil
+}
+
+func sendEvent(events chan<- ChangeEvent, stop <-chan struct{}, ev ChangeEvent) {
+	select {
+	case events <- ev:
+	case <-stop:
+	}
+}